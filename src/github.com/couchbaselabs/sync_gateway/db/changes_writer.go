@@ -2,9 +2,14 @@ package db
 
 import (
 	"bytes"
-	"math/rand"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbaselabs/walrus"
@@ -15,42 +20,94 @@ import (
 
 //////// CHANGES WRITER
 
+// LogMode controls how a channelLogWriter behaves when its queue is full.
+type LogMode int
+
+const (
+	// Blocking is the default: addChange blocks until there's room in the queue.
+	Blocking LogMode = iota
+	// NonBlocking never blocks addChange; once the ring buffer is full it evicts
+	// the oldest pending entry and counts the drop.
+	NonBlocking
+)
+
+// Configures a changesWriter and the channelLogWriters it creates.
+type changesWriterConfig struct {
+	LogMode LogMode
+
+	// Max encoded size a log segment is allowed to reach before it's sealed and a new one
+	// started. Zero means kDefaultTargetSegmentSize.
+	TargetSegmentSize int
+
+	// How long a channelLogWriter waits after a write before checking for more changes to
+	// coalesce, to limit the number of WriteUpdate calls. Zero means kDefaultCoalesceDelay.
+	CoalesceDelay time.Duration
+}
+
 // Coordinates writing changes to channel-log documents. A singleton owned by a DatabaseContext.
 type changesWriter struct {
+	ctx        context.Context // cancelling this stops every channelLogWriter cleanly
 	bucket     base.Bucket
+	config     changesWriterConfig
 	logWriters map[string]*channelLogWriter
+	sinks      []*sinkWriter
 	lock       sync.Mutex
 }
 
-// Creates a new changesWriter
-func newChangesWriter(bucket base.Bucket) *changesWriter {
-	return &changesWriter{bucket: bucket, logWriters: map[string]*channelLogWriter{}}
+// Creates a new changesWriter. ctx's cancellation tears down every channelLogWriter it creates.
+func newChangesWriter(ctx context.Context, bucket base.Bucket) *changesWriter {
+	return newChangesWriterWithConfig(ctx, bucket, changesWriterConfig{})
 }
 
-// Adds a change to all relevant logs, asynchronously.
-func (c *changesWriter) addToChangeLogs(changedChannels base.Set, channelMap ChannelMap, entry channels.LogEntry, parentRevID string) error {
-	var err error
+// Creates a new changesWriter with an explicit LogMode, applied to every channelLogWriter it creates.
+func newChangesWriterWithLogMode(ctx context.Context, bucket base.Bucket, logMode LogMode) *changesWriter {
+	return newChangesWriterWithConfig(ctx, bucket, changesWriterConfig{LogMode: logMode})
+}
+
+// Creates a new changesWriter with an explicit config, applied to every channelLogWriter it creates.
+func newChangesWriterWithConfig(ctx context.Context, bucket base.Bucket, config changesWriterConfig) *changesWriter {
+	if config.TargetSegmentSize <= 0 {
+		config.TargetSegmentSize = kDefaultTargetSegmentSize
+	}
+	if config.CoalesceDelay <= 0 {
+		config.CoalesceDelay = kDefaultCoalesceDelay
+	}
+	return &changesWriter{ctx: ctx, bucket: bucket, config: config, logWriters: map[string]*channelLogWriter{}}
+}
+
+// Adds a change to all relevant logs, asynchronously, and returns a WriteTicket the caller can
+// use to wait for those writes to become durable (see WriteTicket.SyncWait).
+func (c *changesWriter) addToChangeLogs(changedChannels base.Set, channelMap ChannelMap, entry channels.LogEntry, parentRevID string) (*WriteTicket, error) {
 	base.LogTo("Changes", "Updating #%d %q/%q in channels %s", entry.Sequence, entry.DocID, entry.RevID, changedChannels)
+
+	// Figure out which channel-logs this entry will actually be written to, so the ticket
+	// can be created with the right count before any of the writes are enqueued.
+	type logWrite struct {
+		channel string
+		removed bool
+	}
+	var writes []logWrite
 	for channel, removal := range channelMap {
 		if removal != nil && removal.Seq != entry.Sequence {
 			continue
 		}
+		writes = append(writes, logWrite{channel: channel, removed: removal != nil})
+	}
+	if EnableStarChannelLog {
+		writes = append(writes, logWrite{channel: "*"})
+	}
+
+	ticket := newWriteTicket(len(writes))
+	for _, w := range writes {
 		// Set Removed flag appropriately for this channel:
-		if removal != nil {
+		if w.removed {
 			entry.Flags |= channels.Removed
 		} else {
 			entry.Flags = entry.Flags &^ channels.Removed
 		}
-		c.addToChangeLog(channel, entry, parentRevID)
-	}
-
-	// Finally, add to the universal "*" channel.
-	if EnableStarChannelLog {
-		entry.Flags = entry.Flags &^ channels.Removed
-		c.addToChangeLog("*", entry, parentRevID)
+		c.addToChangeLog(w.channel, entry, parentRevID, ticket)
 	}
-
-	return err
+	return ticket, nil
 }
 
 // Blocks until all pending channel-log updates are complete.
@@ -63,9 +120,11 @@ func (c *changesWriter) checkpoint() {
 	c.logWriters = map[string]*channelLogWriter{}
 }
 
-// Adds a change to a single channel-log (asynchronously)
-func (c *changesWriter) addToChangeLog(channelName string, entry channels.LogEntry, parentRevID string) {
-	c.logWriterForChannel(channelName).addChange(entry, parentRevID)
+// Adds a change to a single channel-log (asynchronously), signaling ticket once it's durable,
+// and mirrors it to every registered ChangeSink.
+func (c *changesWriter) addToChangeLog(channelName string, entry channels.LogEntry, parentRevID string, ticket *WriteTicket) {
+	c.logWriterForChannel(channelName).addChange(entry, parentRevID, ticket)
+	c.mirrorToSinks(channelName, entry, parentRevID)
 }
 
 // Saves a channel log (asynchronously), _if_ there isn't already one in the database.
@@ -73,20 +132,32 @@ func (c *changesWriter) addChangeLog(channelName string, log *channels.ChangeLog
 	c.logWriterForChannel(channelName).addChannelLog(log)
 }
 
-// Loads a channel's log from the database and returns it.
+// Loads a channel's log from the database and returns it. Reads the channel's manifest and
+// only fetches the segments whose sequence range could contain something after afterSeq.
 func (c *changesWriter) getChangeLog(channelName string, afterSeq uint64) (*channels.ChangeLog, error) {
-	if raw, err := c.bucket.GetRaw(channelLogDocID(channelName)); err == nil {
-		log, err := decodeChannelLog(raw)
-		if err == nil {
-			log.FilterAfter(afterSeq)
+	manifest, err := loadChannelLogManifest(c.bucket, channelName)
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	for _, seg := range manifest.Segments {
+		if seg.LastSeq != 0 && seg.LastSeq <= afterSeq {
+			continue // every entry in this segment is already known to the caller
 		}
-		return log, err
-	} else {
-		if base.IsDocNotFoundError(err) {
-			err = nil
+		segRaw, err := c.bucket.GetRaw(channelLogSegmentDocID(channelName, seg.Num))
+		if err != nil {
+			if base.IsDocNotFoundError(err) {
+				continue
+			}
+			return nil, err
 		}
-		return nil, err
+		raw.Write(segRaw)
 	}
+
+	log := channels.DecodeChangeLog(bytes.NewReader(raw.Bytes()))
+	log.FilterAfter(afterSeq)
+	return log, nil
 }
 
 // Internal: returns a channelLogWriter that writes to the given channel.
@@ -95,57 +166,376 @@ func (c *changesWriter) logWriterForChannel(channelName string) *channelLogWrite
 	defer c.lock.Unlock()
 	logWriter := c.logWriters[channelName]
 	if logWriter == nil {
-		logWriter = newChannelLogWriter(c.bucket, channelName)
+		logWriter = newChannelLogWriter(c.ctx, c.bucket, channelName, c.config)
 		c.logWriters[channelName] = logWriter
 	}
 	return logWriter
 }
 
+//////// CHANGE SINKS
+
+// A ChangeSink mirrors channel-log writes somewhere else in-process -- e.g. a Kafka or NATS
+// publisher, a webhook relay, or metrics. It's given a copy of every entry written to any
+// channel, independent of (and never blocking) the primary bucket write path.
+type ChangeSink interface {
+	Write(channel string, entry channels.LogEntry, parentRevID string) error
+	Close()
+}
+
+// Max number of pending writes buffered for a single sink before it's considered dead.
+const kSinkQueueLength = 1000
+
+// Wraps a registered ChangeSink with its own buffered queue and goroutine, so a slow or dead
+// sink can never stall addToChangeLog.
+type sinkWriter struct {
+	sink  ChangeSink
+	queue chan sinkWrite
+}
+
+type sinkWrite struct {
+	channel     string
+	entry       channels.LogEntry
+	parentRevID string
+}
+
+func newSinkWriter(sink ChangeSink) *sinkWriter {
+	w := &sinkWriter{sink: sink, queue: make(chan sinkWrite, kSinkQueueLength)}
+	go w.run()
+	return w
+}
+
+func (w *sinkWriter) run() {
+	for write := range w.queue {
+		if err := w.sink.Write(write.channel, write.entry, write.parentRevID); err != nil {
+			base.Warn("ChangeSink %T: Write failed: %v", w.sink, err)
+		}
+	}
+	w.sink.Close()
+}
+
+// AddSink registers a ChangeSink to mirror every future channel-log write.
+func (c *changesWriter) AddSink(sink ChangeSink) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sinks = append(c.sinks, newSinkWriter(sink))
+}
+
+// CloseSinks stops every registered sink's goroutine and calls its Close method.
+func (c *changesWriter) CloseSinks() {
+	c.lock.Lock()
+	sinks := c.sinks
+	c.sinks = nil
+	c.lock.Unlock()
+	for _, w := range sinks {
+		close(w.queue)
+	}
+}
+
+// Fans an entry out to every registered sink. A sink whose queue is full is assumed dead (or
+// too slow to keep up): it's dropped from the active set instead of being allowed to block.
+func (c *changesWriter) mirrorToSinks(channel string, entry channels.LogEntry, parentRevID string) {
+	c.lock.Lock()
+	sinks := c.sinks
+	c.lock.Unlock()
+	if len(sinks) == 0 {
+		return
+	}
+
+	write := sinkWrite{channel: channel, entry: entry, parentRevID: parentRevID}
+	var dead []*sinkWriter
+	for _, w := range sinks {
+		select {
+		case w.queue <- write:
+		default:
+			dead = append(dead, w)
+		}
+	}
+	if len(dead) > 0 {
+		c.dropDeadSinks(dead)
+	}
+}
+
+// Removes the given sinks from the active set and closes their queues.
+func (c *changesWriter) dropDeadSinks(dead []*sinkWriter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	isDead := make(map[*sinkWriter]bool, len(dead))
+	for _, w := range dead {
+		isDead[w] = true
+	}
+	// Built into a fresh array, not c.sinks[:0]: mirrorToSinks reads c.sinks' backing array
+	// lock-free, so overwriting it in place here would race with that read.
+	kept := make([]*sinkWriter, 0, len(c.sinks))
+	for _, w := range c.sinks {
+		if isDead[w] {
+			base.Warn("ChangeSink %T: queue full, removing from active set", w.sink)
+			close(w.queue)
+			continue
+		}
+		kept = append(kept, w)
+	}
+	c.sinks = kept
+}
+
+// FuncSink adapts a plain function to the ChangeSink interface.
+type FuncSink func(channel string, entry channels.LogEntry, parentRevID string) error
+
+func (f FuncSink) Write(channel string, entry channels.LogEntry, parentRevID string) error {
+	return f(channel, entry, parentRevID)
+}
+
+func (f FuncSink) Close() {}
+
+// RecordedWrite is one write captured by a RecordingSink.
+type RecordedWrite struct {
+	Channel     string
+	Entry       channels.LogEntry
+	ParentRevID string
+}
+
+// RecordingSink is a ChangeSink that records every write it receives, for use in tests.
+type RecordingSink struct {
+	lock   sync.Mutex
+	writes []RecordedWrite
+}
+
+func (s *RecordingSink) Write(channel string, entry channels.LogEntry, parentRevID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writes = append(s.writes, RecordedWrite{Channel: channel, Entry: entry, ParentRevID: parentRevID})
+	return nil
+}
+
+func (s *RecordingSink) Close() {}
+
+// Records returns a snapshot of every write recorded so far.
+func (s *RecordingSink) Records() []RecordedWrite {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	records := make([]RecordedWrite, len(s.writes))
+	copy(records, s.writes)
+	return records
+}
+
 //////// CHANNEL LOG WRITER
 
 // Writes changes to a single channel log.
 type channelLogWriter struct {
-	bucket      base.Bucket
-	channelName string
-	io          chan *changeEntry
-	awake       chan bool
+	bucket            base.Bucket
+	channelName       string
+	logMode           LogMode
+	targetSegmentSize int
+	coalesceDelay     time.Duration
+	io                chan *changeEntry
+	awake             chan bool
+
+	ctx    context.Context // cancelling this stops the writer's goroutines cleanly
+	cancel context.CancelFunc
+
+	retentionSeq uint64 // atomic; segments entirely below this are eligible for GC
+
+	// ringLock guards ringBuf, ringHead, ringLen, droppedCount and lastDropWarn; all are only
+	// used in NonBlocking mode. ringBuf is a fixed-capacity circular buffer -- evicting the
+	// oldest entry is an O(1) overwrite-and-advance-head, never a slice-shift or a reallocation.
+	ringLock     sync.Mutex
+	ringBuf      []*changeEntry
+	ringHead     int // index of the oldest live entry in ringBuf
+	ringLen      int // number of live entries in ringBuf
+	droppedCount int64
+	lastDropWarn time.Time
+	notify       chan bool // signals the background goroutine that the ring is non-empty
 }
 
 type changeEntry struct {
 	logEntry       *channels.LogEntry
 	parentRevID    string
 	replacementLog *channels.ChangeLog
+	ticket         *WriteTicket // may be nil if the caller doesn't care about durability
+}
+
+// A WriteTicket lets a caller wait for one or more enqueued channel-log writes to become
+// durable, without blocking the enqueue itself. Returned by changesWriter.addToChangeLogs;
+// callers that don't need read-your-writes can just ignore it. A REST handler, for example,
+// might call SyncWait before responding to a document PUT made with "?durable=true".
+type WriteTicket struct {
+	wg  sync.WaitGroup
+	mu  sync.Mutex
+	err error
+}
+
+// Dropped entries in NonBlocking mode are resolved with this error so a waiter never hangs.
+var errDroppedFromQueue = errors.New("channel log entry dropped from a full non-blocking queue")
+
+func newWriteTicket(numWrites int) *WriteTicket {
+	ticket := &WriteTicket{}
+	ticket.wg.Add(numWrites)
+	return ticket
+}
+
+// markDurable signals that one of the writes behind this ticket has completed (successfully or
+// not). The ticket's error is the first non-nil error seen across all of its writes.
+func (t *WriteTicket) markDurable(err error) {
+	if err != nil {
+		t.mu.Lock()
+		if t.err == nil {
+			t.err = err
+		}
+		t.mu.Unlock()
+	}
+	t.wg.Done()
+}
+
+// SyncWait blocks until every write behind this ticket is durable, returning the first error
+// encountered (if any).
+func (t *WriteTicket) SyncWait() error {
+	t.wg.Wait()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
 }
 
 // Max number of pending writes
 const kChannelLogWriterQueueLength = 1000
 
-// Creates a channelLogWriter for a particular channel.
-func newChannelLogWriter(bucket base.Bucket, channelName string) *channelLogWriter {
+// Counts entries dropped by NonBlocking channelLogWriters, keyed by channel name.
+var channelLogDroppedCount = expvar.NewMap("channelLog_droppedEntries")
+
+// Minimum time between "queue full, dropping oldest entry" log messages per channel.
+const kDroppedEntryLogThrottle = 1 * time.Minute
+
+// Default max encoded size of a channel-log segment before it's sealed and a new one started.
+const kDefaultTargetSegmentSize = 16 * 1024 * 1024
+
+// How often each channelLogWriter checks its manifest for segments that can be GC'd.
+const kSegmentGCInterval = 5 * time.Minute
+
+// Default delay between a write and checking for more changes to coalesce into the next one.
+// (This used to be a literal `time.Sleep(50)`, which is 50 *nanoseconds* -- not the intended
+// ~50ms -- so in practice every batch was written essentially back-to-back.)
+const kDefaultCoalesceDelay = 50 * time.Millisecond
+
+// One append-only segment of a channel's log, as recorded in its manifest.
+type channelLogSegment struct {
+	Num      int    `json:"num"`
+	FirstSeq uint64 `json:"firstSeq"`
+	LastSeq  uint64 `json:"lastSeq"`
+	Size     int    `json:"size"`
+}
+
+// Tracks the segments that make up a channel's log. Stored at the channel's log doc ID
+// (what used to hold the whole log); the segments themselves live at "<docID>:<num>".
+type channelLogManifest struct {
+	CurNum   int                 `json:"curNum"`
+	Segments []channelLogSegment `json:"segments"`
+}
+
+// Returned by the segment WriteUpdate callback when the new entries won't fit in the
+// current segment, so the caller needs to seal it and retry against a fresh one.
+var errSegmentFull = errors.New("channel log segment is full")
+
+// Creates a channelLogWriter for a particular channel. Cancelling ctx stops it cleanly,
+// flushing whatever's currently buffered before its goroutines exit.
+func newChannelLogWriter(ctx context.Context, bucket base.Bucket, channelName string, config changesWriterConfig) *channelLogWriter {
 	c := &channelLogWriter{
-		bucket:      bucket,
-		channelName: channelName,
-		io:          make(chan *changeEntry, kChannelLogWriterQueueLength),
-		awake:       make(chan bool, 1),
-	}
-	go func() {
-		// This is the goroutine the channelLogWriter runs:
-		for {
-			if changes := c.readChanges_(); changes != nil {
-				c.addToChangeLog_(c.massageChanges(changes))
-				time.Sleep(50) // lowering rate helps to coalesce changes, limiting # of writes
-			} else {
-				break // client called close
+		bucket:            bucket,
+		channelName:       channelName,
+		logMode:           config.LogMode,
+		targetSegmentSize: config.TargetSegmentSize,
+		coalesceDelay:     config.CoalesceDelay,
+		io:                make(chan *changeEntry, kChannelLogWriterQueueLength),
+		awake:             make(chan bool, 1),
+	}
+	if c.targetSegmentSize <= 0 {
+		c.targetSegmentSize = kDefaultTargetSegmentSize
+	}
+	if c.coalesceDelay <= 0 {
+		c.coalesceDelay = kDefaultCoalesceDelay
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	if c.logMode == NonBlocking {
+		c.notify = make(chan bool, 1)
+		c.ringBuf = make([]*changeEntry, kChannelLogWriterQueueLength)
+	}
+	go c.run()
+	go c.runSegmentGC()
+	return c
+}
+
+// This is the goroutine the channelLogWriter runs to drain and write changes.
+func (c *channelLogWriter) run() {
+	defer close(c.awake)
+	for {
+		changes, shuttingDown := c.nextBatch()
+		if len(changes) > 0 {
+			err := c.addToChangeLog_(c.massageChanges(changes))
+			// One WriteUpdate call covers the whole batch, so it signals every ticket in it:
+			for _, change := range changes {
+				if change.ticket != nil {
+					change.ticket.markDurable(err)
+				}
+			}
+			if !shuttingDown {
+				c.sleepCoalesceDelay() // limits the rate of writes, letting changes coalesce
 			}
 		}
-		close(c.awake)
-	}()
-	return c
+		if shuttingDown {
+			return
+		}
+	}
 }
 
-// Queues a change to be written to the change-log.
-func (c *channelLogWriter) addChange(entry channels.LogEntry, parentRevID string) {
-	c.io <- &changeEntry{logEntry: &entry, parentRevID: parentRevID}
+// Pauses for coalesceDelay, or until the writer is cancelled -- whichever happens first, so
+// shutdown never has to wait out a full delay.
+func (c *channelLogWriter) sleepCoalesceDelay() {
+	select {
+	case <-time.After(c.coalesceDelay):
+	case <-c.ctx.Done():
+	}
+}
+
+// Queues a change to be written to the change-log, signaling ticket (if non-nil) once it's
+// durable. In Blocking mode this blocks once the queue is full; in NonBlocking mode it never
+// blocks, evicting the oldest pending entry (and counting the drop) instead.
+func (c *channelLogWriter) addChange(entry channels.LogEntry, parentRevID string, ticket *WriteTicket) {
+	change := &changeEntry{logEntry: &entry, parentRevID: parentRevID, ticket: ticket}
+	if c.logMode == NonBlocking {
+		c.addChangeNonBlocking(change)
+		return
+	}
+	c.io <- change
+}
+
+// Appends a change to the ring buffer, overwriting the oldest pending entry if it's full. This
+// is an O(1) slot overwrite, not a slice-shift-and-append: the latter looks append-cheap but
+// forces an occasional O(n) reallocation-and-copy of the whole buffer, exactly the kind of
+// hot-path cost NonBlocking mode exists to avoid.
+func (c *channelLogWriter) addChangeNonBlocking(change *changeEntry) {
+	c.ringLock.Lock()
+	var dropped *changeEntry
+	if c.ringLen == len(c.ringBuf) {
+		dropped = c.ringBuf[c.ringHead]
+		c.ringBuf[c.ringHead] = change
+		c.ringHead = (c.ringHead + 1) % len(c.ringBuf)
+		c.droppedCount++
+		channelLogDroppedCount.Add(c.channelName, 1)
+		if now := time.Now(); now.Sub(c.lastDropWarn) >= kDroppedEntryLogThrottle {
+			c.lastDropWarn = now
+			base.Warn("channelLogWriter: queue for channel %q is full, dropping oldest entry (dropped %d so far)",
+				c.channelName, c.droppedCount)
+		}
+	} else {
+		tail := (c.ringHead + c.ringLen) % len(c.ringBuf)
+		c.ringBuf[tail] = change
+		c.ringLen++
+	}
+	if dropped != nil && dropped.ticket != nil {
+		dropped.ticket.markDurable(errDroppedFromQueue)
+	}
+	c.ringLock.Unlock()
+	select {
+	case c.notify <- true:
+	default:
+	}
 }
 
 // Queues an entire new channel log to be written
@@ -153,52 +543,168 @@ func (c *channelLogWriter) addChannelLog(log *channels.ChangeLog) {
 	c.io <- &changeEntry{replacementLog: log}
 }
 
-// Stops the background goroutine of a channelLogWriter.
+// Stops the background goroutines of a channelLogWriter, flushing whatever's currently
+// buffered first.
 func (c *channelLogWriter) stop() {
-	close(c.io)
-	<-c.awake // block until goroutine finishes
+	c.cancel()
+	<-c.awake // block until the run() goroutine finishes flushing and exits
 }
 
-func (c *channelLogWriter) readChange_() *changeEntry {
+// SetRetentionSeq sets the minimum sequence the channel log needs to retain; sealed segments
+// entirely below it become eligible for GC. The default, 0, disables GC.
+func (c *channelLogWriter) SetRetentionSeq(seq uint64) {
+	atomic.StoreUint64(&c.retentionSeq, seq)
+}
+
+// Periodically prunes sealed segments that have fallen below the retention watermark.
+func (c *channelLogWriter) runSegmentGC() {
+	ticker := time.NewTicker(kSegmentGCInterval)
+	defer ticker.Stop()
 	for {
-		entry, ok := <-c.io
-		if !ok {
-			return nil
-		} else if entry.replacementLog != nil {
-			// Request to create the channel log if it doesn't exist:
-			c.addChangeLog_(entry.replacementLog)
-		} else {
-			return entry
+		select {
+		case <-ticker.C:
+			c.pruneSegments()
+		case <-c.ctx.Done():
+			return
 		}
 	}
 }
 
-// Reads all available changes from io and returns them as an array, or nil if io is closed.
-func (c *channelLogWriter) readChanges_() []*changeEntry {
-	// Read first:
-	entry := c.readChange_()
-	if entry == nil {
+// Deletes sealed segments that are entirely below the retention watermark.
+func (c *channelLogWriter) pruneSegments() {
+	retention := atomic.LoadUint64(&c.retentionSeq)
+	if retention == 0 {
+		return
+	}
+	manifest, err := loadChannelLogManifest(c.bucket, c.channelName)
+	if err != nil || manifest == nil {
+		return
+	}
+
+	// Delete the segment docs first, then drop just those numbers from the manifest; the
+	// manifest update is applied against whatever's current when it runs, so it can't clobber
+	// a concurrent segment-seal's CurNum/Segments update.
+	deleted := make(map[int]bool)
+	for _, seg := range manifest.Segments {
+		if seg.Num != manifest.CurNum && seg.LastSeq != 0 && seg.LastSeq < retention {
+			err := c.bucket.Delete(channelLogSegmentDocID(c.channelName, seg.Num))
+			if err != nil && !base.IsDocNotFoundError(err) {
+				base.Warn("channelLogWriter: failed to GC segment %d of %q: %v", seg.Num, c.channelName, err)
+				continue
+			}
+			deleted[seg.Num] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return
+	}
+
+	err = saveChannelLogManifest(c.bucket, c.channelName, func(m *channelLogManifest) error {
+		kept := make([]channelLogSegment, 0, len(m.Segments))
+		for _, seg := range m.Segments {
+			if !deleted[seg.Num] {
+				kept = append(kept, seg)
+			}
+		}
+		m.Segments = kept
 		return nil
+	})
+	if err != nil {
+		base.Warn("channelLogWriter: failed to save manifest for %q after GC: %v", c.channelName, err)
 	}
-	// Try to read more as long as they're available:
-	entries := []*changeEntry{entry}
-loop:
-	for len(entries) < kChannelLogWriterQueueLength {
-		var ok bool
+}
+
+// Returns the next batch of changes to write, or (nil, true) once the writer has been
+// cancelled and has nothing left to flush.
+func (c *channelLogWriter) nextBatch() (changes []*changeEntry, shuttingDown bool) {
+	if c.logMode == NonBlocking {
+		return c.nextBatchNonBlocking()
+	}
+	return c.nextBatchBlocking()
+}
+
+// Drains the io channel: blocks until it has something to return, or ctx is cancelled (in
+// which case it drains whatever's already queued before returning).
+func (c *channelLogWriter) nextBatchBlocking() ([]*changeEntry, bool) {
+	var entries []*changeEntry
+	for len(entries) == 0 {
 		select {
-		case entry, ok = <-c.io:
-			if !ok {
-				break loop
-			} else if entry.replacementLog != nil {
+		case entry := <-c.io:
+			if entry.replacementLog != nil {
 				// Request to create the channel log if it doesn't exist:
 				c.addChangeLog_(entry.replacementLog)
-			} else {
-				entries = append(entries, entry)
+				continue
+			}
+			entries = append(entries, entry)
+		case <-c.ctx.Done():
+			return c.drainIO(), true
+		}
+	}
+	// Opportunistically grab anything else already queued, without blocking further:
+	for len(entries) < kChannelLogWriterQueueLength {
+		select {
+		case entry := <-c.io:
+			if entry.replacementLog != nil {
+				c.addChangeLog_(entry.replacementLog)
+				continue
 			}
+			entries = append(entries, entry)
 		default:
-			break loop
+			return entries, false
 		}
 	}
+	return entries, false
+}
+
+// Non-blocking drain of whatever's currently sitting in the io channel, with no further wait.
+func (c *channelLogWriter) drainIO() []*changeEntry {
+	var entries []*changeEntry
+	for {
+		select {
+		case entry := <-c.io:
+			if entry.replacementLog != nil {
+				c.addChangeLog_(entry.replacementLog)
+				continue
+			}
+			entries = append(entries, entry)
+		default:
+			return entries
+		}
+	}
+}
+
+// Drains the ring buffer in FIFO order, blocking until it's non-empty or ctx is cancelled. Also
+// services addChannelLog requests, which still flow through the io channel.
+func (c *channelLogWriter) nextBatchNonBlocking() ([]*changeEntry, bool) {
+	for {
+		if entries := c.takeRing(); entries != nil {
+			return entries, false
+		}
+		select {
+		case entry := <-c.io:
+			if entry.replacementLog != nil {
+				// Request to create the channel log if it doesn't exist:
+				c.addChangeLog_(entry.replacementLog)
+			}
+		case <-c.notify:
+		case <-c.ctx.Done():
+			return c.takeRing(), true
+		}
+	}
+}
+
+// Atomically empties the ring buffer and returns its former contents, or nil if it was empty.
+func (c *channelLogWriter) takeRing() []*changeEntry {
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+	if c.ringLen == 0 {
+		return nil
+	}
+	entries := make([]*changeEntry, c.ringLen)
+	for i := 0; i < c.ringLen; i++ {
+		entries[i] = c.ringBuf[(c.ringHead+i)%len(c.ringBuf)]
+	}
+	c.ringHead, c.ringLen = 0, 0
 	return entries
 }
 
@@ -208,15 +714,25 @@ func (c *channelLogWriter) massageChanges(changes []*changeEntry) []*changeEntry
 	return changes
 }
 
-// Saves a channel log, _if_ there isn't already one in the database.
+// Saves a channel log, _if_ there isn't already one in the database. The log is written as a
+// single segment 0, since we have no per-entry sequence boundaries to split it on; its range
+// is left open-ended so getChangeLog always considers it.
 func (c *channelLogWriter) addChangeLog_(log *channels.ChangeLog) (added bool, err error) {
-	added, err = c.bucket.AddRaw(channelLogDocID(c.channelName), 0, encodeChannelLog(log))
+	added, err = c.bucket.AddRaw(channelLogSegmentDocID(c.channelName, 0), 0, encodeChannelLog(log))
 	if added {
+		manifestErr := saveChannelLogManifest(c.bucket, c.channelName, func(m *channelLogManifest) error {
+			m.CurNum = 0
+			m.Segments = []channelLogSegment{{Num: 0, FirstSeq: 0, LastSeq: ^uint64(0), Size: log.Len()}}
+			return nil
+		})
+		if manifestErr != nil {
+			err = manifestErr
+		}
 		base.LogTo("Changes", "Added missing channel-log %q with %d entries",
 			c.channelName, log.Len())
 	} else {
 		base.LogTo("Changes", "Didn't add channel-log %q with %d entries (err=%v)",
-			c.channelName, log.Len())
+			c.channelName, log.Len(), err)
 	}
 	return
 }
@@ -229,63 +745,83 @@ func (cl changeEntryList) Less(i, j int) bool {
 }
 func (cl changeEntryList) Swap(i, j int) { cl[i], cl[j] = cl[j], cl[i] }
 
-// Writes new changes to my channel log document.
+// Writes new changes to the current segment of my channel log, sealing it and starting a
+// fresh one first if the entries wouldn't fit within targetSegmentSize.
 func (c *channelLogWriter) addToChangeLog_(entries []*changeEntry) error {
-	var fullUpdate bool
-	var removedCount int
-	fullUpdateAttempts := 0
-
-	logDocID := channelLogDocID(c.channelName)
-	err := c.bucket.WriteUpdate(logDocID, 0, func(currentValue []byte) ([]byte, walrus.WriteOptions, error) {
-		// (Be careful: this block can be invoked multiple times if there are races!)
-		// Should I do a full update of the change log, removing older entries to limit its size?
-		// This has to be done occasionaly, but it's slower than simply appending to it. This
-		// test is a heuristic that seems to strike a good balance in practice:
-		fullUpdate = AlwaysCompactChangeLog ||
-			(len(currentValue) > 20000 && (rand.Intn(100) < len(currentValue)/5000))
-		removedCount = 0
-
-		numToKeep := MaxChangeLogLength - len(entries)
-		if len(currentValue) == 0 || numToKeep <= 0 {
-			// If the log was empty, create a new log and return:
-			if numToKeep < 0 {
-				entries = entries[-numToKeep:]
-			}
-			channelLog := channels.ChangeLog{}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	manifest, err := loadChannelLogManifest(c.bucket, c.channelName)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &channelLogManifest{}
+	}
+
+	segNum := manifest.CurNum
+	var newSize int
+	err = c.bucket.WriteUpdate(channelLogSegmentDocID(c.channelName, segNum), 0,
+		func(currentValue []byte) ([]byte, walrus.WriteOptions, error) {
+			// (Be careful: this block can be invoked multiple times if there are races!)
+			w := bytes.NewBuffer(make([]byte, 0, 50000))
 			for _, entry := range entries {
-				channelLog.Add(*entry.logEntry)
+				entry.logEntry.Encode(w, entry.parentRevID)
 			}
-			return encodeChannelLog(&channelLog), walrus.Raw, nil
-		} else if fullUpdate {
-			fullUpdateAttempts++
-			var newValue bytes.Buffer
-			removedCount = channels.TruncateEncodedChangeLog(bytes.NewReader(currentValue),
-				numToKeep, numToKeep/2, &newValue)
-			if removedCount > 0 {
-				for _, entry := range entries {
-					entry.logEntry.Encode(&newValue, entry.parentRevID)
-				}
-				return newValue.Bytes(), walrus.Raw, nil
+			if len(currentValue) > 0 && len(currentValue)+w.Len() > c.targetSegmentSize {
+				return nil, walrus.Raw, errSegmentFull
 			}
+			newValue := append(currentValue, w.Bytes()...)
+			newSize = len(newValue)
+			return newValue, walrus.Raw, nil
+		})
+
+	if err == errSegmentFull {
+		// Seal the current segment and retry the batch against a fresh one. Condition the bump
+		// on CurNum still being segNum, since saveChannelLogManifest may retry this against a
+		// manifest a concurrent GC or writer has already moved on.
+		err := saveChannelLogManifest(c.bucket, c.channelName, func(m *channelLogManifest) error {
+			if m.CurNum == segNum {
+				m.CurNum = segNum + 1
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
+		base.LogTo("Changes", "Sealed channel-log %q segment %d, starting segment %d",
+			c.channelName, segNum, segNum+1)
+		return c.addToChangeLog_(entries)
+	} else if err != nil {
+		return err
+	}
 
-		// Append the encoded form of the new entries to the raw log bytes:
-		w := bytes.NewBuffer(make([]byte, 0, 50000))
-		for _, entry := range entries {
-			entry.logEntry.Encode(w, entry.parentRevID)
-		}
-		currentValue = append(currentValue, w.Bytes()...)
-		return currentValue, walrus.Raw, nil
+	firstSeq, lastSeq := entries[0].logEntry.Sequence, entries[len(entries)-1].logEntry.Sequence
+	err = saveChannelLogManifest(c.bucket, c.channelName, func(m *channelLogManifest) error {
+		recordSegmentWrite(m, segNum, firstSeq, lastSeq, newSize)
+		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	base.LogTo("Changes", "Wrote %d sequence(s) to channel log %q", len(entries), c.channelName)
+	base.LogTo("Changes", "Wrote %d sequence(s) to channel log %q segment %d", len(entries), c.channelName, segNum)
+	return nil
+}
 
-	/*if fullUpdate {
-		base.Log("Removed %d entries from %q", removedCount, c.channelName)
-	} else if fullUpdateAttempts > 0 {
-		base.Log("Attempted to remove entries %d times but failed", fullUpdateAttempts)
-	}*/
-	return err
+// Updates a manifest's record of a segment's sequence range and size after a successful write.
+func recordSegmentWrite(manifest *channelLogManifest, segNum int, firstSeq, lastSeq uint64, size int) {
+	for i := range manifest.Segments {
+		if manifest.Segments[i].Num == segNum {
+			manifest.Segments[i].LastSeq = lastSeq
+			manifest.Segments[i].Size = size
+			return
+		}
+	}
+	manifest.Segments = append(manifest.Segments, channelLogSegment{
+		Num: segNum, FirstSeq: firstSeq, LastSeq: lastSeq, Size: size,
+	})
 }
 
 //////// SUBROUTINES:
@@ -298,11 +834,84 @@ func channelLogDocID(channelName string) string {
 	return kChannelLogKeyPrefix + channelName
 }
 
-func decodeChannelLog(raw []byte) (*channels.ChangeLog, error) {
-	if raw == nil {
+// The doc ID of one append-only segment of a channel's log.
+func channelLogSegmentDocID(channelName string, segNum int) string {
+	return fmt.Sprintf("%s:%d", channelLogDocID(channelName), segNum)
+}
+
+// Loads a channel's segment manifest, or returns nil if it doesn't have one yet.
+func loadChannelLogManifest(bucket base.Bucket, channelName string) (*channelLogManifest, error) {
+	raw, err := bucket.GetRaw(channelLogDocID(channelName))
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(raw) == 0 {
 		return nil, nil
 	}
-	return channels.DecodeChangeLog(bytes.NewReader(raw)), nil
+	var manifest channelLogManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		// Pre-segmentation channel logs stored their raw encoded bytes at this exact doc ID;
+		// migrate one in place the first time we see it rather than failing every read.
+		return migrateLegacyChannelLog(bucket, channelName, raw)
+	}
+	return &manifest, nil
+}
+
+// Migrates a pre-segmentation channel log -- whose doc held the raw encoded log directly -- to
+// the segmented format: the existing bytes become segment 0, and a manifest pointing at them
+// replaces them at the original doc ID. Safe to race with a concurrent migrator or writer:
+// AddRaw only succeeds once, and the manifest write leaves an already-migrated value alone.
+func migrateLegacyChannelLog(bucket base.Bucket, channelName string, legacyRaw []byte) (*channelLogManifest, error) {
+	if _, err := bucket.AddRaw(channelLogSegmentDocID(channelName, 0), 0, legacyRaw); err != nil {
+		return nil, err
+	}
+	err := bucket.WriteUpdate(channelLogDocID(channelName), 0, func(currentValue []byte) ([]byte, walrus.WriteOptions, error) {
+		var existing channelLogManifest
+		if json.Unmarshal(currentValue, &existing) == nil && len(existing.Segments) > 0 {
+			return currentValue, walrus.Raw, nil // already migrated by us on a retry, or a racer
+		}
+		manifest := &channelLogManifest{
+			CurNum:   0,
+			Segments: []channelLogSegment{{Num: 0, FirstSeq: 0, LastSeq: ^uint64(0), Size: len(legacyRaw)}},
+		}
+		raw, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, walrus.Raw, err
+		}
+		return raw, walrus.Raw, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	base.LogTo("Changes", "Migrated pre-segmentation channel-log %q to segmented format", channelName)
+	return loadChannelLogManifest(bucket, channelName)
+}
+
+// Applies mutate to a channel's segment manifest and saves the result. mutate is called with
+// the manifest decoded from the latest currentValue, so it may be invoked multiple times if
+// there's a write conflict with another caller (e.g. a concurrent GC or segment seal) -- it
+// should apply its delta idempotently rather than assuming the manifest it sees is the one
+// that was last loaded outside the callback.
+func saveChannelLogManifest(bucket base.Bucket, channelName string, mutate func(manifest *channelLogManifest) error) error {
+	return bucket.WriteUpdate(channelLogDocID(channelName), 0, func(currentValue []byte) ([]byte, walrus.WriteOptions, error) {
+		var manifest channelLogManifest
+		if len(currentValue) > 0 {
+			if err := json.Unmarshal(currentValue, &manifest); err != nil {
+				return nil, walrus.Raw, err
+			}
+		}
+		if err := mutate(&manifest); err != nil {
+			return nil, walrus.Raw, err
+		}
+		raw, err := json.Marshal(&manifest)
+		if err != nil {
+			return nil, walrus.Raw, err
+		}
+		return raw, walrus.Raw, nil
+	})
 }
 
 func encodeChannelLog(log *channels.ChangeLog) []byte {
@@ -312,4 +921,4 @@ func encodeChannelLog(log *channels.ChangeLog) []byte {
 	raw := bytes.NewBuffer(make([]byte, 0, 50000))
 	log.Encode(raw)
 	return raw.Bytes()
-}
\ No newline at end of file
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// A large CoalesceDelay would leave a buffered-but-unwritten entry sitting for that whole
+// duration if a channelLogWriter ever waited out the delay *before* writing. It doesn't: the
+// delay only separates one write from checking for the next, so a channel with a single pending
+// entry (the low-traffic case chunk0-4 names) is written immediately rather than sitting
+// unflushed. This is the property that let chunk0-4's flushInterval plumbing be dropped as dead
+// code in e019467.
+func TestChannelLogWriterFlushesWithoutWaitingOutCoalesceDelay(t *testing.T) {
+	bucket := newTestBucket(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newChannelLogWriter(ctx, bucket, "chan", changesWriterConfig{CoalesceDelay: time.Hour})
+	defer c.stop()
+
+	ticket := newWriteTicket(1)
+	c.addChange(channels.LogEntry{Sequence: 1}, "1-a", ticket)
+
+	done := make(chan error, 1)
+	go func() { done <- ticket.SyncWait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("entry wasn't flushed promptly; CoalesceDelay should only apply between writes, not before the first one")
+	}
+}
+
+// Cancelling a channelLogWriter's context must unblock stop() promptly and flush whatever's
+// already buffered on the io channel (Blocking mode), rather than waiting out CoalesceDelay.
+func TestStopFlushesBufferedEntriesBeforeReturning(t *testing.T) {
+	bucket := newTestBucket(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newChannelLogWriter(ctx, bucket, "chan", changesWriterConfig{CoalesceDelay: time.Hour})
+
+	ticket := newWriteTicket(1)
+	c.addChange(channels.LogEntry{Sequence: 1}, "1-a", ticket)
+
+	stopped := make(chan struct{})
+	go func() {
+		c.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop() should unblock promptly by cancelling the coalesce-delay sleep, not wait out CoalesceDelay")
+	}
+
+	if err := ticket.SyncWait(); err != nil {
+		t.Fatalf("ticket should be durable once stop() returns: %v", err)
+	}
+	manifest, err := loadChannelLogManifest(bucket, "chan")
+	if err != nil || manifest == nil || len(manifest.Segments) == 0 {
+		t.Fatalf("expected a flushed segment after stop(), got %+v, %v", manifest, err)
+	}
+}
+
+// Same guarantee as above, but for NonBlocking mode: stop() must drain the ring buffer (not
+// just the io channel) before returning.
+func TestStopFlushesRingBufferedEntriesBeforeReturning(t *testing.T) {
+	bucket := newTestBucket(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newChannelLogWriter(ctx, bucket, "chan", changesWriterConfig{
+		LogMode:       NonBlocking,
+		CoalesceDelay: time.Hour,
+	})
+
+	ticket := newWriteTicket(1)
+	c.addChange(channels.LogEntry{Sequence: 1}, "1-a", ticket) // lands in the ring, not the io channel
+
+	stopped := make(chan struct{})
+	go func() {
+		c.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop() in NonBlocking mode should drain the ring promptly, not wait out CoalesceDelay")
+	}
+
+	if err := ticket.SyncWait(); err != nil {
+		t.Fatalf("ticket should be durable once stop() returns: %v", err)
+	}
+	manifest, err := loadChannelLogManifest(bucket, "chan")
+	if err != nil || manifest == nil || len(manifest.Segments) == 0 {
+		t.Fatalf("expected a flushed segment after stop(), got %+v, %v", manifest, err)
+	}
+}
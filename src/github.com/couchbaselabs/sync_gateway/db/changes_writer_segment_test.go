@@ -0,0 +1,114 @@
+package db
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// addToChangeLog_ should seal the current segment and start a fresh one once writing to it
+// would exceed targetSegmentSize, rather than growing the segment unbounded.
+func TestAddToChangeLogSealsFullSegment(t *testing.T) {
+	bucket := newTestBucket(t)
+	c := &channelLogWriter{bucket: bucket, channelName: "chan", targetSegmentSize: 1}
+
+	entry1 := &changeEntry{logEntry: &channels.LogEntry{Sequence: 1}, parentRevID: "1-a"}
+	if err := c.addToChangeLog_([]*changeEntry{entry1}); err != nil {
+		t.Fatalf("first write failed: %v", err)
+	}
+
+	manifest, err := loadChannelLogManifest(bucket, "chan")
+	if err != nil || manifest == nil {
+		t.Fatalf("expected a manifest after the first write, got %v, %v", manifest, err)
+	}
+	if manifest.CurNum != 0 || len(manifest.Segments) != 1 {
+		t.Fatalf("expected segment 0 only after the first write, got %+v", manifest)
+	}
+
+	// targetSegmentSize is 1 byte, so this second write can't fit in segment 0 and should seal
+	// it and roll over to segment 1.
+	entry2 := &changeEntry{logEntry: &channels.LogEntry{Sequence: 2}, parentRevID: "1-a"}
+	if err := c.addToChangeLog_([]*changeEntry{entry2}); err != nil {
+		t.Fatalf("second write failed: %v", err)
+	}
+
+	manifest, err = loadChannelLogManifest(bucket, "chan")
+	if err != nil || manifest == nil {
+		t.Fatalf("expected a manifest after the second write, got %v, %v", manifest, err)
+	}
+	if manifest.CurNum != 1 {
+		t.Errorf("expected CurNum to advance to 1, got %d", manifest.CurNum)
+	}
+	if len(manifest.Segments) != 2 {
+		t.Errorf("expected 2 segments after rollover, got %d", len(manifest.Segments))
+	}
+}
+
+// Regression test for the bug where saveChannelLogManifest took a pre-built *channelLogManifest
+// captured before the WriteUpdate call, instead of merging against the latest currentValue: two
+// concurrent deltas against the same manifest -- one shaped like addToChangeLog_'s segment-seal
+// (bump CurNum), one shaped like pruneSegments' GC (drop a segment) -- must both survive, rather
+// than whichever WriteUpdate call happens to land last silently discarding the other's delta.
+func TestSaveChannelLogManifestMergesConcurrentDeltas(t *testing.T) {
+	bucket := newTestBucket(t)
+	const channel = "chan"
+
+	err := saveChannelLogManifest(bucket, channel, func(m *channelLogManifest) error {
+		m.CurNum = 1
+		m.Segments = []channelLogSegment{
+			{Num: 0, FirstSeq: 1, LastSeq: 10, Size: 100},
+			{Num: 1, FirstSeq: 11, LastSeq: 11, Size: 10},
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("couldn't seed initial manifest: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var sealErr, gcErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Same shape as addToChangeLog_'s seal path: bump CurNum, conditioned on its old value.
+		sealErr = saveChannelLogManifest(bucket, channel, func(m *channelLogManifest) error {
+			if m.CurNum == 1 {
+				m.CurNum = 2
+			}
+			return nil
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		// Same shape as pruneSegments' GC path: drop a specific segment by number.
+		gcErr = saveChannelLogManifest(bucket, channel, func(m *channelLogManifest) error {
+			kept := make([]channelLogSegment, 0, len(m.Segments))
+			for _, seg := range m.Segments {
+				if seg.Num != 0 {
+					kept = append(kept, seg)
+				}
+			}
+			m.Segments = kept
+			return nil
+		})
+	}()
+	wg.Wait()
+	if sealErr != nil {
+		t.Fatalf("segment-seal update failed: %v", sealErr)
+	}
+	if gcErr != nil {
+		t.Fatalf("GC update failed: %v", gcErr)
+	}
+
+	manifest, err := loadChannelLogManifest(bucket, channel)
+	if err != nil || manifest == nil {
+		t.Fatalf("expected a manifest, got %v, %v", manifest, err)
+	}
+	if manifest.CurNum != 2 {
+		t.Errorf("segment-seal's CurNum bump should have survived the concurrent GC write, got CurNum=%d", manifest.CurNum)
+	}
+	if len(manifest.Segments) != 1 || manifest.Segments[0].Num != 1 {
+		t.Errorf("GC's removal of segment 0 should have survived the concurrent seal write, got segments=%+v", manifest.Segments)
+	}
+}
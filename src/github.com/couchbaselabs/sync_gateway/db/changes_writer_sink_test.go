@@ -0,0 +1,50 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// A sink whose Write blocks forever, so its sinkWriter's queue fills up and never drains --
+// standing in for a dead or wedged ChangeSink.
+type blockingSink struct {
+	block chan struct{}
+}
+
+func (s *blockingSink) Write(channel string, entry channels.LogEntry, parentRevID string) error {
+	<-s.block
+	return nil
+}
+
+func (s *blockingSink) Close() {}
+
+// mirrorToSinks should drop a sink once its queue is full, rather than blocking the caller, and
+// dropDeadSinks must remove only the dead sink -- a healthy sink registered alongside it keeps
+// receiving writes.
+func TestMirrorToSinksDropsFullSink(t *testing.T) {
+	c := &changesWriter{}
+	dead := newSinkWriter(&blockingSink{block: make(chan struct{})})
+	healthy := &RecordingSink{}
+	c.sinks = []*sinkWriter{dead, newSinkWriter(healthy)}
+
+	// The blocking sink's single run() goroutine is stuck on its first Write, so the next
+	// kSinkQueueLength writes fill its queue without draining it, and one more overflows it.
+	entry := channels.LogEntry{Sequence: 1}
+	for i := 0; i < kSinkQueueLength+2; i++ {
+		c.mirrorToSinks("chan", entry, "1-a")
+	}
+
+	c.lock.Lock()
+	sinks := c.sinks
+	c.lock.Unlock()
+	if len(sinks) != 1 {
+		t.Fatalf("expected the full sink to be dropped, leaving 1 sink, got %d", len(sinks))
+	}
+	if sinks[0].sink != healthy {
+		t.Errorf("expected the healthy sink to survive, got %T", sinks[0].sink)
+	}
+	if len(healthy.Records()) == 0 {
+		t.Errorf("expected the healthy sink to have received at least one write")
+	}
+}
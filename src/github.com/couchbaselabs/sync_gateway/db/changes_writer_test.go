@@ -0,0 +1,45 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// Returns an in-memory bucket for use by a single test.
+func newTestBucket(t *testing.T) base.Bucket {
+	bucket, err := base.GetBucket(base.BucketSpec{
+		Server:     "walrus:",
+		BucketName: "test_" + t.Name(),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create in-memory test bucket: %v", err)
+	}
+	return bucket
+}
+
+// addChangeNonBlocking's ring buffer should evict the oldest pending entry once it's full,
+// staying bounded at kChannelLogWriterQueueLength entries and preserving FIFO order.
+func TestNonBlockingRingDropsOldest(t *testing.T) {
+	c := &channelLogWriter{channelName: "chan", ringBuf: make([]*changeEntry, kChannelLogWriterQueueLength)}
+
+	entryCount := kChannelLogWriterQueueLength + 1
+	for i := 0; i < entryCount; i++ {
+		c.addChangeNonBlocking(&changeEntry{logEntry: &channels.LogEntry{Sequence: uint64(i)}})
+	}
+
+	if c.ringLen != kChannelLogWriterQueueLength {
+		t.Fatalf("ring should stay bounded at %d entries, has %d", kChannelLogWriterQueueLength, c.ringLen)
+	}
+	if c.droppedCount != 1 {
+		t.Errorf("expected 1 dropped entry, got %d", c.droppedCount)
+	}
+	entries := c.takeRing()
+	if first := entries[0].logEntry.Sequence; first != 1 {
+		t.Errorf("oldest surviving entry should be sequence 1 (sequence 0 was dropped), got %d", first)
+	}
+	if last := entries[len(entries)-1].logEntry.Sequence; last != uint64(entryCount-1) {
+		t.Errorf("newest entry should be sequence %d, got %d", entryCount-1, last)
+	}
+}
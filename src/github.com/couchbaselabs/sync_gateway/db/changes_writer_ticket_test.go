@@ -0,0 +1,57 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// An entry evicted from the NonBlocking ring must resolve its ticket with errDroppedFromQueue,
+// not leave a caller blocked in SyncWait forever.
+func TestDroppedRingEntryTicketResolvesWithError(t *testing.T) {
+	c := &channelLogWriter{channelName: "chan", ringBuf: make([]*changeEntry, kChannelLogWriterQueueLength)}
+
+	firstTicket := newWriteTicket(1)
+	c.addChangeNonBlocking(&changeEntry{logEntry: &channels.LogEntry{Sequence: 0}, ticket: firstTicket})
+	for i := 1; i < kChannelLogWriterQueueLength; i++ {
+		c.addChangeNonBlocking(&changeEntry{logEntry: &channels.LogEntry{Sequence: uint64(i)}})
+	}
+	// The ring is now full; one more push evicts the oldest entry -- the one holding firstTicket.
+	c.addChangeNonBlocking(&changeEntry{logEntry: &channels.LogEntry{Sequence: uint64(kChannelLogWriterQueueLength)}})
+
+	if err := firstTicket.SyncWait(); err != errDroppedFromQueue {
+		t.Errorf("ticket for the evicted entry should resolve with errDroppedFromQueue, got %v", err)
+	}
+}
+
+// A single addToChangeLog_ call covering a batch of entries must signal every ticket in that
+// batch with the same result, mirroring the loop in channelLogWriter.run() -- coalescing
+// several writers' entries into one WriteUpdate shouldn't leave any of their tickets unresolved.
+func TestBatchWriteSignalsAllTicketsInBatch(t *testing.T) {
+	bucket := newTestBucket(t)
+	c := &channelLogWriter{bucket: bucket, channelName: "chan", targetSegmentSize: kDefaultTargetSegmentSize}
+
+	const n = 5
+	changes := make([]*changeEntry, n)
+	tickets := make([]*WriteTicket, n)
+	for i := 0; i < n; i++ {
+		ticket := newWriteTicket(1)
+		tickets[i] = ticket
+		changes[i] = &changeEntry{
+			logEntry:    &channels.LogEntry{Sequence: uint64(i + 1)},
+			parentRevID: "1-a",
+			ticket:      ticket,
+		}
+	}
+
+	err := c.addToChangeLog_(c.massageChanges(changes))
+	for _, change := range changes {
+		change.ticket.markDurable(err)
+	}
+
+	for i, ticket := range tickets {
+		if werr := ticket.SyncWait(); werr != nil {
+			t.Errorf("ticket %d should be durable after the batch write, got %v", i, werr)
+		}
+	}
+}